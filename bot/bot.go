@@ -2,11 +2,13 @@ package bot // import "cirello.io/gochatbot/bot"
 
 import (
 	"fmt"
-	"log"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"cirello.io/gochatbot/brain"
+	"cirello.io/gochatbot/logging"
 	"cirello.io/gochatbot/messages"
 )
 
@@ -17,10 +19,146 @@ type Self struct {
 	providerIn  chan messages.Message
 	providerOut chan messages.Message
 	rules       []RuleParser
+	stats       []StatProcessor
+	admins      []string
+	acl         func(msg messages.Message, ruleName string) bool
+	log         logging.Logger
 
 	brain brain.Memorizer
 }
 
+// WithLogger overrides the bot's default logger, used for the bot's own logs.
+// Rules and StatProcessors do not receive it directly, and providers log
+// through their own loggers built with logging.NewProvider.
+func WithLogger(l logging.Logger) Option {
+	return func(s *Self) {
+		s.log = l
+	}
+}
+
+// correlationSeq generates the correlation IDs attached to every inbound
+// message's logs, so a rule's outbound responses can be traced back to the
+// message that triggered them.
+var correlationSeq uint64
+
+func nextCorrelationID() string {
+	return strconv.FormatUint(atomic.AddUint64(&correlationSeq, 1), 10)
+}
+
+// Scope declares the audience a PrivilegedRule is restricted to.
+type Scope int
+
+const (
+	// AdminOnly restricts a rule to messages from admins, as reported by
+	// Message.IsAdmin or the WithAdmins list.
+	AdminOnly Scope = iota + 1
+	// DirectOnly restricts a rule to direct (one-on-one) messages.
+	DirectOnly
+	// ChannelOnly restricts a rule to shared-channel messages.
+	ChannelOnly
+)
+
+// notAuthorizedMessage is the standard reply sent in place of a rule's own
+// response when the sender fails its required scope or the ACL callback.
+const notAuthorizedMessage = "sorry, you are not authorized to do that."
+
+// PrivilegedRule is the RuleParser sub-interface a rule implements to
+// declare the audience it requires. Self.Process enforces the declared
+// Scope, and the registered WithACL callback, before ever calling
+// ParseMessage.
+type PrivilegedRule interface {
+	RuleParser
+	// Name identifies the rule for the WithACL callback.
+	Name() string
+	// RequiredScope declares the audience this rule is restricted to.
+	RequiredScope() Scope
+}
+
+// WithAdmins registers the set of FromUserID values treated as admins for
+// AdminOnly rules, for providers that have no native concept of admin users.
+func WithAdmins(admins []string) Option {
+	return func(s *Self) {
+		s.admins = admins
+	}
+}
+
+// WithACL registers a callback consulted for every PrivilegedRule, in
+// addition to its RequiredScope. Returning false blocks the rule from
+// running on msg.
+func WithACL(fn func(msg messages.Message, ruleName string) bool) Option {
+	return func(s *Self) {
+		s.acl = fn
+	}
+}
+
+// isAdmin reports whether msg comes from an admin, either because the
+// provider flagged it directly or because FromUserID is in the WithAdmins
+// list.
+func (s *Self) isAdmin(msg messages.Message) bool {
+	if msg.IsAdmin {
+		return true
+	}
+	for _, admin := range s.admins {
+		if admin == msg.FromUserID {
+			return true
+		}
+	}
+	return false
+}
+
+// authorized enforces a PrivilegedRule's RequiredScope and the WithACL
+// callback against msg.
+func (s *Self) authorized(msg messages.Message, rule PrivilegedRule) bool {
+	switch rule.RequiredScope() {
+	case AdminOnly:
+		if !s.isAdmin(msg) {
+			return false
+		}
+	case DirectOnly:
+		if !msg.Direct {
+			return false
+		}
+	case ChannelOnly:
+		if msg.Direct {
+			return false
+		}
+	}
+	if s.acl != nil && !s.acl(msg, rule.Name()) {
+		return false
+	}
+	return true
+}
+
+// statMemoryNamespace is the brain.Memorizer namespace prefix reserved for
+// StatProcessor counters, so they never collide with keys rules save under
+// their own namespaces.
+const statMemoryNamespace = "stats"
+
+// StatProcessor observes every message flowing through the bot alongside the
+// RuleParser chain, without needing to hijack ParseMessage. It is meant for
+// karma counters, leaderboards and other message analytics.
+type StatProcessor interface {
+	// Name identifies the processor. It is also used to namespace its
+	// counters in the bot's Brain.
+	Name() string
+	// Keys lists the counter keys this processor persists. Process logs
+	// the count alongside every "<botname> stats" report, for debugging.
+	Keys() []string
+	// Observe is called once for every inbound message.
+	Observe(msg messages.Message)
+	// Report renders the processor's current counters as zero or more
+	// outbound messages, typically in response to "<botname> stats".
+	Report(self Self) []messages.Message
+}
+
+// WithStatProcessors registers StatProcessors to be fed every inbound
+// message alongside the bot's RuleParsers.
+func WithStatProcessors(procs ...StatProcessor) Option {
+	return func(s *Self) {
+		s.stats = append(s.stats, procs...)
+	}
+}
+
 var processOnce sync.Once // protects Process
 
 // Option type is the self-referencing method of tweaking gobot's internals.
@@ -33,8 +171,9 @@ func New(name string, memo brain.Memorizer, opts ...Option) *Self {
 		brain:       memo,
 		providerIn:  make(chan messages.Message),
 		providerOut: make(chan messages.Message),
+		log:         logging.New().With(logging.Str("subsystem", "bot")),
 	}
-	log.Println("bot: applying options")
+	s.log.Info("applying options")
 	for _, opt := range opts {
 		opt(s)
 	}
@@ -46,33 +185,81 @@ func New(name string, memo brain.Memorizer, opts ...Option) *Self {
 // in its own goroutine.
 func (s *Self) Process() {
 	processOnce.Do(func() {
-		log.Println("bot: starting main loop")
+		s.log.Info("starting main loop")
 		for in := range s.providerIn {
+			correlationID := nextCorrelationID()
+			msgLog := s.log.With(logging.Str("correlation_id", correlationID))
+			msgLog.Debug("received message", logging.Str("room", in.Room), logging.Str("from", in.FromUserID))
+
+			send := func(msg messages.Message) {
+				msg.CorrelationID = correlationID
+				msgLog.Debug("dispatching outbound message", logging.Str("room", msg.Room), logging.Str("to", msg.ToUserID))
+				s.providerOut <- msg
+			}
+
+			for _, stat := range s.stats {
+				go func(proc StatProcessor, msg messages.Message) {
+					defer func() {
+						if r := recover(); r != nil {
+							msgLog.Error("panic recovered when observing message for stat processor", fmt.Errorf("%v", r), logging.Str("stat_processor", proc.Name()))
+						}
+					}()
+					proc.Observe(msg)
+				}(stat, in)
+			}
+
 			if strings.HasPrefix(in.Message, s.Name()+" help") {
 				go func(self Self, msg messages.Message) {
 					helpMsg := fmt.Sprintln("available commands:")
 					for _, rule := range s.rules {
 						helpMsg = fmt.Sprintln(helpMsg, rule.HelpMessage(self))
 					}
-					s.providerOut <- messages.Message{
+					send(messages.Message{
 						Room:       msg.Room,
 						ToUserID:   msg.FromUserID,
 						ToUserName: msg.FromUserName,
 						Message:    helpMsg,
+					})
+				}(*s, in)
+				continue
+			}
+
+			if strings.HasPrefix(in.Message, s.Name()+" stats") {
+				go func(self Self, msg messages.Message) {
+					for _, stat := range s.stats {
+						msgLog.Debug("reporting stat processor", logging.Str("stat_processor", stat.Name()), logging.Int("keys", len(stat.Keys())))
+						for _, r := range stat.Report(self) {
+							send(r)
+						}
 					}
 				}(*s, in)
 				continue
 			}
+
 			go func(self Self, msg messages.Message) {
 				defer func() {
 					if r := recover(); r != nil {
-						log.Printf("panic recovered when parsing message: %#v. Panic: %v", msg, r)
+						msgLog.Error("panic recovered when parsing message", fmt.Errorf("%v", r))
 					}
 				}()
+				rejected := false
 				for _, rule := range s.rules {
+					if pr, ok := rule.(PrivilegedRule); ok && !s.authorized(msg, pr) {
+						msgLog.Debug("rule rejected by ACL", logging.Str("rule", pr.Name()))
+						if !rejected {
+							rejected = true
+							send(messages.Message{
+								Room:       msg.Room,
+								ToUserID:   msg.FromUserID,
+								ToUserName: msg.FromUserName,
+								Message:    notAuthorizedMessage,
+							})
+						}
+						continue
+					}
 					responses := rule.ParseMessage(self, msg)
 					for _, r := range responses {
-						s.providerOut <- r
+						send(r)
 					}
 				}
 			}(*s, in)
@@ -90,6 +277,20 @@ func (s *Self) MemorySave(namespace, key string, value []byte) {
 	s.brain.Save(namespace, key, value)
 }
 
+// StatMemoryRead reads a counter previously saved by a StatProcessor named
+// proc. It namespaces the read under the reserved stats namespace so
+// processors never collide with rule-owned memory.
+func (s *Self) StatMemoryRead(proc, key string) []byte {
+	return s.MemoryRead(statMemoryNamespace+":"+proc, key)
+}
+
+// StatMemorySave persists a counter on behalf of the StatProcessor named
+// proc. It namespaces the write under the reserved stats namespace so
+// processors never collide with rule-owned memory.
+func (s *Self) StatMemorySave(proc, key string, value []byte) {
+	s.MemorySave(statMemoryNamespace+":"+proc, key, value)
+}
+
 // MessageProviderOut getter for message dispatch channel
 func (s *Self) MessageProviderOut() chan messages.Message {
 	return s.providerOut
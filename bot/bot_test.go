@@ -0,0 +1,123 @@
+package bot
+
+import (
+	"testing"
+
+	"cirello.io/gochatbot/messages"
+)
+
+type fakeRule struct {
+	name  string
+	scope Scope
+}
+
+func (fakeRule) HelpMessage(Self) string                                { return "" }
+func (fakeRule) ParseMessage(Self, messages.Message) []messages.Message { return nil }
+func (r fakeRule) Name() string                                         { return r.name }
+func (r fakeRule) RequiredScope() Scope                                 { return r.scope }
+
+func TestAuthorized(t *testing.T) {
+	tests := []struct {
+		name string
+		s    *Self
+		msg  messages.Message
+		rule PrivilegedRule
+		want bool
+	}{
+		{
+			name: "admin only, admin message",
+			s:    &Self{},
+			msg:  messages.Message{IsAdmin: true},
+			rule: fakeRule{name: "r", scope: AdminOnly},
+			want: true,
+		},
+		{
+			name: "admin only, non-admin message",
+			s:    &Self{},
+			msg:  messages.Message{IsAdmin: false},
+			rule: fakeRule{name: "r", scope: AdminOnly},
+			want: false,
+		},
+		{
+			name: "admin only, FromUserID in WithAdmins list",
+			s:    &Self{admins: []string{"U1"}},
+			msg:  messages.Message{FromUserID: "U1"},
+			rule: fakeRule{name: "r", scope: AdminOnly},
+			want: true,
+		},
+		{
+			name: "direct only, direct message",
+			s:    &Self{},
+			msg:  messages.Message{Direct: true},
+			rule: fakeRule{name: "r", scope: DirectOnly},
+			want: true,
+		},
+		{
+			name: "direct only, channel message",
+			s:    &Self{},
+			msg:  messages.Message{Direct: false},
+			rule: fakeRule{name: "r", scope: DirectOnly},
+			want: false,
+		},
+		{
+			name: "channel only, channel message",
+			s:    &Self{},
+			msg:  messages.Message{Direct: false},
+			rule: fakeRule{name: "r", scope: ChannelOnly},
+			want: true,
+		},
+		{
+			name: "channel only, direct message",
+			s:    &Self{},
+			msg:  messages.Message{Direct: true},
+			rule: fakeRule{name: "r", scope: ChannelOnly},
+			want: false,
+		},
+		{
+			name: "ACL callback rejects an otherwise-authorized message",
+			s: &Self{acl: func(msg messages.Message, ruleName string) bool {
+				return false
+			}},
+			msg:  messages.Message{IsAdmin: true},
+			rule: fakeRule{name: "r", scope: AdminOnly},
+			want: false,
+		},
+		{
+			name: "ACL callback allows an otherwise-authorized message",
+			s: &Self{acl: func(msg messages.Message, ruleName string) bool {
+				return true
+			}},
+			msg:  messages.Message{IsAdmin: true},
+			rule: fakeRule{name: "r", scope: AdminOnly},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.s.authorized(tt.msg, tt.rule); got != tt.want {
+				t.Errorf("authorized() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsAdmin(t *testing.T) {
+	tests := []struct {
+		name string
+		s    *Self
+		msg  messages.Message
+		want bool
+	}{
+		{"provider-flagged admin", &Self{}, messages.Message{IsAdmin: true}, true},
+		{"not in admins list", &Self{admins: []string{"U1"}}, messages.Message{FromUserID: "U2"}, false},
+		{"in admins list", &Self{admins: []string{"U1"}}, messages.Message{FromUserID: "U1"}, true},
+		{"no admins configured", &Self{}, messages.Message{FromUserID: "U1"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.s.isAdmin(tt.msg); got != tt.want {
+				t.Errorf("isAdmin() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+// Package logging provides the structured logger used across gochatbot. It
+// wraps zerolog so that call sites (bot, providers) depend on a small
+// interface instead of a concrete logging library.
+package logging // import "cirello.io/gochatbot/logging"
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// levelEnvVarName selects the minimum level logged, e.g. "debug", "info",
+// "warn", "error". Defaults to "info" when unset or invalid.
+const levelEnvVarName = "GOCHATBOT_LOG_LEVEL"
+
+// formatEnvVarName switches the output between structured JSON (the
+// default) and a human-readable console writer, e.g. "console".
+const formatEnvVarName = "GOCHATBOT_LOG_FORMAT"
+
+// Logger is the structured logging interface used throughout gochatbot.
+// Fields let call sites attach arbitrary key/value context (e.g.
+// "correlation_id") without importing zerolog directly.
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Error(msg string, err error, fields ...Field)
+
+	// With returns a child logger that always carries the given field,
+	// e.g. Log.With(logging.Str("provider", "slack")).
+	With(fields ...Field) Logger
+}
+
+// Field is a single structured logging key/value pair. Use Str or Int to
+// build one.
+type Field struct {
+	key   string
+	value interface{}
+}
+
+// Str builds a string Field.
+func Str(key, value string) Field {
+	return Field{key: key, value: value}
+}
+
+// Int builds an integer Field.
+func Int(key string, value int) Field {
+	return Field{key: key, value: value}
+}
+
+// New builds the default Logger, configured from levelEnvVarName and
+// formatEnvVarName.
+func New() Logger {
+	var w io.Writer = os.Stderr
+	if strings.EqualFold(os.Getenv(formatEnvVarName), "console") {
+		w = zerolog.ConsoleWriter{Out: os.Stderr}
+	}
+	return zerologLogger{logger: zerolog.New(w).Level(parseLevel(os.Getenv(levelEnvVarName))).With().Timestamp().Logger()}
+}
+
+// NewProvider builds a Logger tagged with field "provider"=name. Its level
+// defaults to levelEnvVarName, but can be overridden per-provider with
+// GOCHATBOT_LOG_LEVEL_<NAME>, e.g. GOCHATBOT_LOG_LEVEL_SLACK=debug.
+func NewProvider(name string) Logger {
+	level := parseLevel(os.Getenv(levelEnvVarName))
+	if override := os.Getenv(levelEnvVarName + "_" + strings.ToUpper(name)); override != "" {
+		if lvl, err := zerolog.ParseLevel(strings.ToLower(override)); err == nil {
+			level = lvl
+		}
+	}
+
+	var w io.Writer = os.Stderr
+	if strings.EqualFold(os.Getenv(formatEnvVarName), "console") {
+		w = zerolog.ConsoleWriter{Out: os.Stderr}
+	}
+	logger := zerolog.New(w).Level(level).With().Timestamp().Str("provider", name).Logger()
+	return zerologLogger{logger: logger}
+}
+
+func parseLevel(s string) zerolog.Level {
+	if s == "" {
+		return zerolog.InfoLevel
+	}
+	lvl, err := zerolog.ParseLevel(strings.ToLower(s))
+	if err != nil {
+		return zerolog.InfoLevel
+	}
+	return lvl
+}
+
+type zerologLogger struct {
+	logger zerolog.Logger
+}
+
+func (l zerologLogger) Debug(msg string, fields ...Field) {
+	apply(l.logger.Debug(), fields).Msg(msg)
+}
+
+func (l zerologLogger) Info(msg string, fields ...Field) {
+	apply(l.logger.Info(), fields).Msg(msg)
+}
+
+func (l zerologLogger) Error(msg string, err error, fields ...Field) {
+	apply(l.logger.Error().Err(err), fields).Msg(msg)
+}
+
+func (l zerologLogger) With(fields ...Field) Logger {
+	ctx := l.logger.With()
+	for _, f := range fields {
+		ctx = ctx.Interface(f.key, f.value)
+	}
+	return zerologLogger{logger: ctx.Logger()}
+}
+
+func apply(e *zerolog.Event, fields []Field) *zerolog.Event {
+	for _, f := range fields {
+		e = e.Interface(f.key, f.value)
+	}
+	return e
+}
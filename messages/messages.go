@@ -6,4 +6,78 @@ type Message struct {
 	FromUserID   string
 	FromUserName string
 	Message      string
+
+	ToUserID   string
+	ToUserName string
+
+	// Direct reports whether the message was sent through a one-on-one
+	// channel (a DM) rather than a shared one. Every provider must fill
+	// this in on inbound messages.
+	Direct bool
+
+	// IsAdmin reports whether FromUserID is known by the provider's
+	// backend to be a workspace/server administrator. Every provider
+	// must fill this in on inbound messages; providers with no concept
+	// of admin users should leave it false.
+	IsAdmin bool
+
+	// Attachments renders Slack-style message attachments. Providers that
+	// do not support attachments should ignore this field.
+	Attachments []Attachment
+
+	// Blocks carries a raw Slack Block Kit payload (already marshaled
+	// JSON). Providers that do not support Block Kit should ignore this
+	// field.
+	Blocks []byte
+
+	// ThreadTS, when set, asks the provider to reply within the thread
+	// rooted at the given provider-specific timestamp/ID instead of
+	// starting a new one.
+	ThreadTS string
+
+	// IconEmoji, IconURL and Username let a rule override the bot's
+	// default appearance for a single message. Providers that cannot
+	// customize per-message identity should ignore these fields.
+	IconEmoji string
+	IconURL   string
+	Username  string
+
+	// Files lists files to be uploaded alongside the message. Providers
+	// that do not support file uploads should ignore this field.
+	Files []File
+
+	// CorrelationID ties an outbound message back to the inbound message
+	// that triggered it, so bot and provider logs can be traced
+	// end-to-end. Set by bot.Self.Process; providers should log it
+	// alongside their own dispatch messages but are not required to
+	// transmit it to the backend.
+	CorrelationID string
+}
+
+// Attachment mirrors Slack's message attachment format: a colored block of
+// text with an optional title, link and a table of fields.
+type Attachment struct {
+	Color      string
+	Title      string
+	TitleLink  string
+	Text       string
+	Fields     []AttachmentField
+	MarkdownIn []string
+}
+
+// AttachmentField is a single title/value pair rendered inside an
+// Attachment. Short marks that the field may be rendered side-by-side with
+// its neighbor.
+type AttachmentField struct {
+	Title string
+	Value string
+	Short bool
+}
+
+// File represents a file to be uploaded alongside a message, such as a
+// snippet or an image generated by a rule.
+type File struct {
+	Name    string
+	Content []byte
+	Type    string
 }
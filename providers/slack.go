@@ -1,71 +1,116 @@
+//go:build all || slack
 // +build all slack
 
 package providers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"html"
 	"html/template"
-	"log"
+	"math/rand"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/net/websocket"
+	"github.com/gorilla/websocket"
 
+	"cirello.io/gochatbot/logging"
 	"cirello.io/gochatbot/messages"
 )
 
 const (
 	slackEnvVarName = "GOCHATBOT_SLACK_TOKEN"
 	urlSlackAPI     = "https://slack.com/api/"
+
+	// slackAppTokenEnvVarName, when set alongside slackEnvVarName, selects
+	// Socket Mode over the deprecated RTM API. See SlackSocketMode.
+	slackAppTokenEnvVarName = "GOCHATBOT_SLACK_APP_TOKEN"
+	// slackForceRTMEnvVarName keeps the legacy RTM provider reachable even
+	// when an app token is present, for backward compatibility.
+	slackForceRTMEnvVarName = "GOCHATBOT_SLACK_FORCE_RTM"
+)
+
+// Connection tuning for the supervised RTM websocket: how long to wait
+// between reconnect attempts (with jitter), how often to ping the peer, and
+// how long to wait for a pong before declaring the connection dead.
+const (
+	minReconnectBackoff = 1 * time.Second
+	maxReconnectBackoff = 60 * time.Second
+	pingInterval        = 30 * time.Second
+	pongWait            = 2 * pingInterval
+	writeWait           = 10 * time.Second
+
+	// outboundQueueSize bounds how many outbound messages are buffered
+	// while the connection is down. Once full, sends block instead of
+	// dropping, applying backpressure to rules.
+	outboundQueueSize = 256
 )
 
 func init() {
 	availableProviders = append(availableProviders, func(getenv func(string) string) (Provider, bool) {
+		log := logging.NewProvider("slack")
 		token := getenv(slackEnvVarName)
 		if token == "" {
-			log.Println("providers: skipping Slack. if you want Slack enabled, please set a valid value for the environment variables", slackEnvVarName)
+			log.Info("skipping Slack. if you want Slack enabled, please set a valid value for the environment variable", logging.Str("env_var", slackEnvVarName))
 			return nil, false
 		}
-		return Slack(token), true
+		if appToken := getenv(slackAppTokenEnvVarName); appToken != "" && getenv(slackForceRTMEnvVarName) == "" {
+			return SlackSocketMode(context.Background(), appToken, token), true
+		}
+		return Slack(context.Background(), token), true
 	})
 }
 
 type providerSlack struct {
-	token    string
-	wsURL    string
-	selfID   string
-	wsConnMu sync.Mutex
-	wsConn   *websocket.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	token  string
+	wsURL  string
+	selfID string
 
 	in  chan messages.Message
 	out chan messages.Message
 	err error
 
-	mu        sync.Mutex
-	usernames map[string]string
+	healthy int32 // atomic bool, read via Healthy()
+
+	mu    sync.Mutex
+	users map[string]slackUserInfo
+
+	log logging.Logger
 }
 
-// Slack is the message provider meant to be used in development of rule sets.
-func Slack(token string) *providerSlack {
+// slackUserInfo caches the subset of users.info this provider needs to
+// populate messages.Message.
+type slackUserInfo struct {
+	name    string
+	isAdmin bool
+}
+
+// Slack is the message provider meant to be used in development of rule
+// sets. It supervises its own RTM websocket connection, reconnecting with
+// exponential backoff on failure, and shuts down cleanly when ctx is
+// canceled.
+func Slack(ctx context.Context, token string) *providerSlack {
+	ctx, cancel := context.WithCancel(ctx)
 	slack := &providerSlack{
-		token:     token,
-		in:        make(chan messages.Message),
-		out:       make(chan messages.Message),
-		usernames: make(map[string]string),
-	}
-	slack.handshake()
-	slack.dial()
-	if slack.err == nil {
-		go slack.intakeLoop()
-		go slack.dispatchLoop()
-	}
-	go slack.reconnect()
+		ctx:    ctx,
+		cancel: cancel,
+		token:  token,
+		in:     make(chan messages.Message),
+		out:    make(chan messages.Message, outboundQueueSize),
+		users:  make(map[string]slackUserInfo),
+		log:    logging.NewProvider("slack"),
+	}
+	go slack.supervise()
 	return slack
 }
 
@@ -81,12 +126,82 @@ func (p *providerSlack) Error() error {
 	return p.err
 }
 
-func (p *providerSlack) handshake() {
-	log.Println("slack: connecting to HTTP API handshake interface")
+// Healthy reports whether the RTM websocket is currently connected.
+func (p *providerSlack) Healthy() bool {
+	return atomic.LoadInt32(&p.healthy) == 1
+}
+
+// Close cancels the provider's context, tearing down the supervised
+// connection.
+func (p *providerSlack) Close() {
+	p.cancel()
+}
+
+// supervise owns the RTM connection's lifecycle: it connects, runs a
+// session until the connection drops, then reconnects with exponential
+// backoff and jitter, until ctx is canceled.
+func (p *providerSlack) supervise() {
+	backoff := minReconnectBackoff
+	for {
+		if p.ctx.Err() != nil {
+			return
+		}
+
+		conn, err := p.connect()
+		if err != nil {
+			p.err = err
+			atomic.StoreInt32(&p.healthy, 0)
+			p.log.Error("failed to connect, backing off", err, logging.Str("backoff", backoff.String()))
+			select {
+			case <-time.After(jitter(backoff)):
+			case <-p.ctx.Done():
+				return
+			}
+			backoff = nextBackoff(backoff)
+			continue
+		}
+
+		p.err = nil
+		backoff = minReconnectBackoff
+		atomic.StoreInt32(&p.healthy, 1)
+		p.log.Info("connected")
+
+		p.runSession(conn)
+
+		atomic.StoreInt32(&p.healthy, 0)
+		p.log.Info("disconnected, will retry")
+	}
+}
+
+// jitter adds up to 50% random jitter on top of d, so many bots reconnecting
+// at once do not all hammer Slack in lockstep.
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// nextBackoff doubles d, capped at maxReconnectBackoff.
+func nextBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d > maxReconnectBackoff {
+		d = maxReconnectBackoff
+	}
+	return d
+}
+
+// connect performs the rtm.start handshake and dials the resulting
+// websocket URL.
+func (p *providerSlack) connect() (*websocket.Conn, error) {
+	if err := p.handshake(); err != nil {
+		return nil, err
+	}
+	return p.dial()
+}
+
+func (p *providerSlack) handshake() error {
+	p.log.Debug("connecting to HTTP API handshake interface")
 	resp, err := http.Get(fmt.Sprint(urlSlackAPI, "rtm.start?no_unreads&simple_latest&token=", p.token))
 	if err != nil {
-		p.err = err
-		return
+		return err
 	}
 	defer resp.Body.Close()
 	var data struct {
@@ -97,55 +212,107 @@ func (p *providerSlack) handshake() {
 		} `json:"self"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-		p.err = err
-		return
+		return err
 	}
 
-	switch v := data.OK.(type) {
-	case bool:
-		if !v {
-			p.err = err
-			return
-		}
-	default:
-		p.err = err
-		return
+	if ok, isBool := data.OK.(bool); !isBool || !ok {
+		return fmt.Errorf("slack: rtm.start reported failure")
 	}
 	p.wsURL = data.URL
 	p.selfID = data.Self.ID
+	return nil
 }
 
-func (p *providerSlack) dial() {
-	log.Println("slack: dialing to HTTP WS rtm interface")
+func (p *providerSlack) dial() (*websocket.Conn, error) {
+	p.log.Debug("dialing to HTTP WS rtm interface")
 	if p.wsURL == "" {
-		p.err = fmt.Errorf("could not connnect to Slack HTTP WS rtm. please, check your connection and your token (%s). error: %v", slackEnvVarName, p.err)
-		return
+		return nil, fmt.Errorf("could not connect to Slack HTTP WS rtm. please, check your connection and your token (%s)", slackEnvVarName)
 	}
-	ws, err := websocket.Dial(p.wsURL, "", urlSlackAPI)
+	conn, _, err := websocket.DefaultDialer.Dial(p.wsURL, nil)
 	if err != nil {
-		p.err = err
-		return
+		return nil, err
 	}
-	p.wsConnMu.Lock()
-	p.wsConn = ws
-	p.wsConnMu.Unlock()
+	return conn, nil
 }
 
-func (p *providerSlack) intakeLoop() {
-	log.Println("slack: started message intake loop")
+// runSession drives a single websocket connection: it reads incoming
+// frames, drains p.out for writes, and pings the peer on an interval,
+// tearing the connection down (and returning) the moment any of those fail
+// or ctx is canceled. The caller's supervise loop reconnects afterwards.
+func (p *providerSlack) runSession(conn *websocket.Conn) {
+	done := make(chan struct{})
+	var closeOnce sync.Once
+	stop := func() {
+		closeOnce.Do(func() {
+			close(done)
+			conn.Close()
+		})
+	}
+	defer stop()
+
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer stop()
+		p.intakeLoop(conn, done)
+	}()
+	go func() {
+		defer wg.Done()
+		defer stop()
+		p.dispatchLoop(conn, done)
+	}()
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
 	for {
-		var data struct {
-			Type    string `json:"type"`
-			Channel string `json:"channel"`
-			UserID  string `json:"user"`
-			Text    string `json:"text"`
+		select {
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				p.log.Error("ping failed", err)
+				stop()
+			}
+		case <-done:
+			wg.Wait()
+			return
+		case <-p.ctx.Done():
+			stop()
+			wg.Wait()
+			return
 		}
+	}
+}
 
-		p.wsConnMu.Lock()
-		wsConn := p.wsConn
-		p.wsConnMu.Unlock()
+func (p *providerSlack) intakeLoop(conn *websocket.Conn, done <-chan struct{}) {
+	p.log.Info("started message intake loop")
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
 
-		if err := json.NewDecoder(wsConn).Decode(&data); err != nil {
+		var data struct {
+			Type     string `json:"type"`
+			Channel  string `json:"channel"`
+			UserID   string `json:"user"`
+			Text     string `json:"text"`
+			ThreadTS string `json:"thread_ts"`
+		}
+
+		_, r, err := conn.NextReader()
+		if err != nil {
+			p.log.Error("read failed, ending session", err)
+			return
+		}
+		if err := json.NewDecoder(r).Decode(&data); err != nil {
+			p.log.Error("failed to decode frame, skipping", err)
 			continue
 		}
 
@@ -153,108 +320,279 @@ func (p *providerSlack) intakeLoop() {
 			continue
 		}
 
+		info := p.getUserInfo(data.UserID)
 		msg := messages.Message{
 			Room:         data.Channel,
 			FromUserID:   data.UserID,
-			FromUserName: p.getUserName(data.UserID),
+			FromUserName: info.name,
 			Message:      data.Text,
 			Direct:       strings.HasPrefix(data.Channel, "D"),
+			ThreadTS:     data.ThreadTS,
+			IsAdmin:      info.isAdmin,
 		}
 		p.in <- msg
 	}
 }
 
-func (p *providerSlack) getUserName(id string) string {
+func (p *providerSlack) getUserInfo(id string) slackUserInfo {
 	p.mu.Lock()
-	if name, ok := p.usernames[id]; ok {
+	if info, ok := p.users[id]; ok {
 		p.mu.Unlock()
-		return name
+		return info
 	}
 	p.mu.Unlock()
 
-	log.Println("slack: reading username from id")
+	p.log.Debug("reading user info from id")
 	resp, err := http.Get(fmt.Sprint(urlSlackAPI, "users.info?token=", p.token, "&user=", url.QueryEscape(id)))
 	if err != nil {
-		log.Println("slack: failed reading username - returning blank")
-		return ""
+		p.log.Error("failed reading user info - returning blank", err)
+		return slackUserInfo{}
 	}
 	defer resp.Body.Close()
 
 	var data struct {
 		OK   interface{} `json:"ok"`
 		User struct {
-			Name string `json:"name"`
+			Name    string `json:"name"`
+			IsAdmin bool   `json:"is_admin"`
 		} `json:"user"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-		log.Println("slack: failed parsing username - returning blank")
-		return ""
+		p.log.Error("failed parsing user info - returning blank", err)
+		return slackUserInfo{}
 	}
 
+	info := slackUserInfo{name: data.User.Name, isAdmin: data.User.IsAdmin}
 	p.mu.Lock()
-	p.usernames[id] = data.User.Name
+	p.users[id] = info
 	p.mu.Unlock()
 
-	log.Printf("slack: %s is %v", id, data.User.Name)
-	return p.usernames[id]
+	p.log.Debug("resolved user info", logging.Str("user_id", id), logging.Str("name", info.name))
+	return info
 }
 
-func (p *providerSlack) dispatchLoop() {
-	log.Println("slack: started message dispatch loop")
-	for msg := range p.out {
-		// TODO(ccf): find a way in that text/template does not escape username DMs.
-		var finalMsg bytes.Buffer
-		template.Must(template.New("tmpl").Parse(msg.Message)).Execute(&finalMsg, struct{ User string }{"<@" + msg.ToUserID + ">"})
+// needsRichDispatch reports whether a message uses any of the structured
+// fields that rtm.start's plain websocket protocol cannot express, and must
+// therefore go through chat.postMessage instead.
+func needsRichDispatch(msg messages.Message) bool {
+	return len(msg.Attachments) > 0 || len(msg.Blocks) > 0 || msg.ThreadTS != "" ||
+		msg.IconEmoji != "" || msg.IconURL != "" || msg.Username != "" || len(msg.Files) > 0
+}
 
-		if strings.TrimSpace(finalMsg.String()) == "" {
-			continue
+// dispatchLoop drains p.out for the lifetime of one connection. When done
+// or p.ctx fires, or a websocket write fails, it returns, leaving the
+// messages not yet taken from p.out buffered for the next session. The
+// message whose write failed is not retried.
+func (p *providerSlack) dispatchLoop(conn *websocket.Conn, done <-chan struct{}) {
+	p.log.Info("started message dispatch loop")
+	for {
+		select {
+		case msg := <-p.out:
+			if err := p.dispatch(conn, msg, done); err != nil {
+				p.log.Error("write failed, ending session", err)
+				return
+			}
+		case <-done:
+			return
+		case <-p.ctx.Done():
+			return
 		}
+	}
+}
 
-		data := struct {
-			Type    string `json:"type"`
-			User    string `json:"user"`
-			Channel string `json:"channel"`
-			Text    string `json:"text"`
-		}{"message", p.selfID, msg.Room, html.UnescapeString(finalMsg.String())}
+func (p *providerSlack) dispatch(conn *websocket.Conn, msg messages.Message, done <-chan struct{}) error {
+	p.log.Debug("dispatching message", logging.Str("correlation_id", msg.CorrelationID), logging.Str("room", msg.Room))
 
-		// TODO(ccf): look for an idiomatic way of doing limited writers
-		b, err := json.Marshal(data)
-		if err != nil {
-			continue
+	if needsRichDispatch(msg) {
+		if err := p.postRichMessage(msg); err != nil {
+			p.log.Error("failed to post rich message", err)
 		}
+		return nil
+	}
 
-		wsMsg := string(b)
-		if len(wsMsg) > 16*1024 {
-			continue
-		}
+	// TODO(ccf): find a way in that text/template does not escape username DMs.
+	var finalMsg bytes.Buffer
+	template.Must(template.New("tmpl").Parse(msg.Message)).Execute(&finalMsg, struct{ User string }{"<@" + msg.ToUserID + ">"})
+
+	if strings.TrimSpace(finalMsg.String()) == "" {
+		return nil
+	}
+
+	data := struct {
+		Type    string `json:"type"`
+		User    string `json:"user"`
+		Channel string `json:"channel"`
+		Text    string `json:"text"`
+	}{"message", p.selfID, msg.Room, html.UnescapeString(finalMsg.String())}
+
+	// TODO(ccf): look for an idiomatic way of doing limited writers
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil
+	}
 
-		p.wsConnMu.Lock()
-		wsConn := p.wsConn
-		p.wsConnMu.Unlock()
+	if len(b) > 16*1024 {
+		return nil
+	}
 
-		fmt.Fprint(wsConn, wsMsg)
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+		return err
+	}
 
-		time.Sleep(1 * time.Second) // https://api.slack.com/docs/rate-limits
+	select {
+	case <-time.After(1 * time.Second): // https://api.slack.com/docs/rate-limits
+	case <-done:
+	case <-p.ctx.Done():
 	}
+	return nil
 }
 
-func (p *providerSlack) reconnect() {
-	for {
-		time.Sleep(1 * time.Second)
+// postRichMessage sends msg through chat.postMessage (and files.upload, when
+// msg.Files is set), since rtm.start's websocket protocol has no way to
+// express attachments, blocks, threads or per-message identity overrides.
+func (p *providerSlack) postRichMessage(msg messages.Message) error {
+	if len(msg.Files) > 0 {
+		if err := uploadFiles(p.token, msg); err != nil {
+			return err
+		}
+		if msg.Message == "" && len(msg.Attachments) == 0 && len(msg.Blocks) == 0 {
+			return nil
+		}
+	}
+
+	form := url.Values{}
+	form.Set("token", p.token)
+	form.Set("channel", msg.Room)
+	form.Set("text", msg.Message)
+	form.Set("as_user", "true")
+	if msg.ThreadTS != "" {
+		form.Set("thread_ts", msg.ThreadTS)
+	}
+	if msg.Username != "" {
+		form.Set("username", msg.Username)
+		form.Del("as_user")
+	}
+	if msg.IconEmoji != "" {
+		form.Set("icon_emoji", msg.IconEmoji)
+	}
+	if msg.IconURL != "" {
+		form.Set("icon_url", msg.IconURL)
+	}
+	if len(msg.Attachments) > 0 {
+		b, err := json.Marshal(toSlackAttachments(msg.Attachments))
+		if err != nil {
+			return err
+		}
+		form.Set("attachments", string(b))
+	}
+	if len(msg.Blocks) > 0 {
+		form.Set("blocks", string(msg.Blocks))
+	}
 
-		p.wsConnMu.Lock()
-		wsConn := p.wsConn
-		p.wsConnMu.Unlock()
+	return p.callAPI("chat.postMessage", form)
+}
+
+// slackAttachment is the wire format expected by chat.postMessage.
+type slackAttachment struct {
+	Color      string       `json:"color,omitempty"`
+	Title      string       `json:"title,omitempty"`
+	TitleLink  string       `json:"title_link,omitempty"`
+	Text       string       `json:"text,omitempty"`
+	Fields     []slackField `json:"fields,omitempty"`
+	MarkdownIn []string     `json:"mrkdwn_in,omitempty"`
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+func toSlackAttachments(attachments []messages.Attachment) []slackAttachment {
+	out := make([]slackAttachment, 0, len(attachments))
+	for _, a := range attachments {
+		fields := make([]slackField, 0, len(a.Fields))
+		for _, f := range a.Fields {
+			fields = append(fields, slackField{Title: f.Title, Value: f.Value, Short: f.Short})
+		}
+		out = append(out, slackAttachment{
+			Color:      a.Color,
+			Title:      a.Title,
+			TitleLink:  a.TitleLink,
+			Text:       a.Text,
+			Fields:     fields,
+			MarkdownIn: a.MarkdownIn,
+		})
+	}
+	return out
+}
+
+// uploadFiles pushes each messages.File through files.upload, threading the
+// upload into msg.Room (and msg.ThreadTS, when set). It is shared by every
+// provider that talks to the Slack Web API, regardless of how it dispatches
+// plain messages.
+func uploadFiles(token string, msg messages.Message) error {
+	for _, f := range msg.Files {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("token", token)
+		form.WriteField("channels", msg.Room)
+		form.WriteField("filename", f.Name)
+		if msg.ThreadTS != "" {
+			form.WriteField("thread_ts", msg.ThreadTS)
+		}
+		part, err := form.CreateFormFile("file", f.Name)
+		if err != nil {
+			return err
+		}
+		if _, err := part.Write(f.Content); err != nil {
+			return err
+		}
+		if err := form.Close(); err != nil {
+			return err
+		}
 
-		if wsConn == nil {
-			log.Println("slack: cannot reconnect")
-			break
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprint(urlSlackAPI, "files.upload"), &body)
+		if err != nil {
+			return err
 		}
+		req.Header.Set("Content-Type", form.FormDataContentType())
 
-		if _, err := wsConn.Write([]byte(`{"type":"hello"}`)); err != nil {
-			log.Printf("slack: reconnecting (%v)", err)
-			p.handshake()
-			p.dial()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
 		}
+		if err := decodeSlackOK(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// callAPI performs a token-authenticated POST against the Slack Web API and
+// checks the "ok" envelope field of the response.
+func (p *providerSlack) callAPI(method string, form url.Values) error {
+	resp, err := http.PostForm(fmt.Sprint(urlSlackAPI, method), form)
+	if err != nil {
+		return err
+	}
+	return decodeSlackOK(resp)
+}
+
+// decodeSlackOK consumes resp and returns an error if the Slack Web API
+// reported ok: false.
+func decodeSlackOK(resp *http.Response) error {
+	defer resp.Body.Close()
+	var data struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return err
+	}
+	if !data.OK {
+		return fmt.Errorf("slack: api call failed: %s", data.Error)
 	}
+	return nil
 }
@@ -0,0 +1,412 @@
+//go:build all || slack
+// +build all slack
+
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"cirello.io/gochatbot/logging"
+	"cirello.io/gochatbot/messages"
+)
+
+// providerSlackSocketMode talks to Slack over Socket Mode + the Events API,
+// the replacement for the deprecated rtm.start/RTM websocket protocol used
+// by providerSlack. Like providerSlack, it supervises its own connection,
+// reconnecting with exponential backoff on failure.
+type providerSlackSocketMode struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	appToken string
+	botToken string
+
+	in  chan messages.Message
+	out chan messages.Message
+	err error
+
+	healthy int32 // atomic bool, read via Healthy()
+
+	mu    sync.Mutex
+	users map[string]slackUserInfo
+
+	log logging.Logger
+}
+
+// SlackSocketMode is the message provider that speaks Slack's Events API
+// over a Socket Mode websocket, opened via apps.connections.open. appToken is
+// the app-level token (xapp-...) and botToken is the bot token (xoxb-...)
+// used for outbound chat.postMessage calls. It shuts down cleanly when ctx
+// is canceled.
+func SlackSocketMode(ctx context.Context, appToken, botToken string) *providerSlackSocketMode {
+	ctx, cancel := context.WithCancel(ctx)
+	slack := &providerSlackSocketMode{
+		ctx:      ctx,
+		cancel:   cancel,
+		appToken: appToken,
+		botToken: botToken,
+		in:       make(chan messages.Message),
+		out:      make(chan messages.Message, outboundQueueSize),
+		users:    make(map[string]slackUserInfo),
+		log:      logging.NewProvider("slack"),
+	}
+	go slack.supervise()
+	return slack
+}
+
+func (p *providerSlackSocketMode) IncomingChannel() chan messages.Message {
+	return p.in
+}
+
+func (p *providerSlackSocketMode) OutgoingChannel() chan messages.Message {
+	return p.out
+}
+
+func (p *providerSlackSocketMode) Error() error {
+	return p.err
+}
+
+// Healthy reports whether the Socket Mode websocket is currently connected.
+func (p *providerSlackSocketMode) Healthy() bool {
+	return atomic.LoadInt32(&p.healthy) == 1
+}
+
+// Close cancels the provider's context, tearing down the supervised
+// connection.
+func (p *providerSlackSocketMode) Close() {
+	p.cancel()
+}
+
+// supervise owns the Socket Mode connection's lifecycle: it connects, runs
+// a session until the connection drops, then reconnects with exponential
+// backoff and jitter, until ctx is canceled. It mirrors providerSlack's
+// supervise loop.
+func (p *providerSlackSocketMode) supervise() {
+	backoff := minReconnectBackoff
+	for {
+		if p.ctx.Err() != nil {
+			return
+		}
+
+		conn, err := p.connect()
+		if err != nil {
+			p.err = err
+			atomic.StoreInt32(&p.healthy, 0)
+			p.log.Error("failed to connect, backing off", err, logging.Str("backoff", backoff.String()))
+			select {
+			case <-time.After(jitter(backoff)):
+			case <-p.ctx.Done():
+				return
+			}
+			backoff = nextBackoff(backoff)
+			continue
+		}
+
+		p.err = nil
+		backoff = minReconnectBackoff
+		atomic.StoreInt32(&p.healthy, 1)
+		p.log.Info("connected")
+
+		p.runSession(conn)
+
+		atomic.StoreInt32(&p.healthy, 0)
+		p.log.Info("disconnected, will retry")
+	}
+}
+
+// connect opens a fresh Socket Mode websocket via apps.connections.open.
+func (p *providerSlackSocketMode) connect() (*websocket.Conn, error) {
+	p.log.Debug("opening socket mode connection")
+	form := url.Values{"token": {p.appToken}}
+	resp, err := http.PostForm(fmt.Sprint(urlSlackAPI, "apps.connections.open"), form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var data struct {
+		OK  bool   `json:"ok"`
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	if !data.OK {
+		return nil, fmt.Errorf("slack: apps.connections.open failed")
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(data.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// runSession drives a single Socket Mode connection: it reads and acks
+// envelopes, drains p.out for writes, and pings the peer on an interval,
+// tearing the connection down (and returning) the moment any of those fail
+// or ctx is canceled. The caller's supervise loop reconnects afterwards.
+func (p *providerSlackSocketMode) runSession(conn *websocket.Conn) {
+	done := make(chan struct{})
+	var closeOnce sync.Once
+	stop := func() {
+		closeOnce.Do(func() {
+			close(done)
+			conn.Close()
+		})
+	}
+	defer stop()
+
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer stop()
+		p.intakeLoop(conn, done)
+	}()
+	go func() {
+		defer wg.Done()
+		defer stop()
+		p.dispatchLoop(conn, done)
+	}()
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				p.log.Error("ping failed", err)
+				stop()
+			}
+		case <-done:
+			wg.Wait()
+			return
+		case <-p.ctx.Done():
+			// Force the blocked NextReader in intakeLoop to
+			// unblock immediately instead of waiting out the
+			// read deadline.
+			stop()
+			wg.Wait()
+			return
+		}
+	}
+}
+
+// socketModeEnvelope is the outer frame Socket Mode wraps every dispatched
+// event in. Every envelope must be ack'd by echoing its EnvelopeID back.
+type socketModeEnvelope struct {
+	EnvelopeID string          `json:"envelope_id"`
+	Type       string          `json:"type"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// eventsAPIPayload is the subset of the events_api envelope payload this
+// provider understands.
+type eventsAPIPayload struct {
+	Event struct {
+		Type     string `json:"type"`
+		Channel  string `json:"channel"`
+		User     string `json:"user"`
+		Text     string `json:"text"`
+		ThreadTS string `json:"thread_ts"`
+		Reaction string `json:"reaction"`
+		// Item carries the channel for events (e.g. reaction_added) that
+		// have no top-level channel field of their own.
+		Item struct {
+			Channel string `json:"channel"`
+		} `json:"item"`
+	} `json:"event"`
+}
+
+func (p *providerSlackSocketMode) intakeLoop(conn *websocket.Conn, done <-chan struct{}) {
+	p.log.Info("started socket mode intake loop")
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		_, r, err := conn.NextReader()
+		if err != nil {
+			p.log.Error("read failed, ending session", err)
+			return
+		}
+
+		var envelope socketModeEnvelope
+		if err := json.NewDecoder(r).Decode(&envelope); err != nil {
+			p.log.Error("failed to decode envelope, skipping", err)
+			continue
+		}
+
+		if envelope.EnvelopeID != "" {
+			p.ack(conn, envelope.EnvelopeID)
+		}
+
+		if envelope.Type != "events_api" {
+			continue
+		}
+
+		var payload eventsAPIPayload
+		if err := json.Unmarshal(envelope.Payload, &payload); err != nil {
+			continue
+		}
+
+		switch payload.Event.Type {
+		case "message", "app_mention", "reaction_added", "member_joined_channel":
+		default:
+			continue
+		}
+
+		room := payload.Event.Channel
+		if room == "" {
+			room = payload.Event.Item.Channel
+		}
+
+		info := p.getUserInfo(payload.Event.User)
+		p.in <- messages.Message{
+			Room:         room,
+			FromUserID:   payload.Event.User,
+			FromUserName: info.name,
+			Message:      payload.Event.Text,
+			Direct:       strings.HasPrefix(room, "D"),
+			ThreadTS:     payload.Event.ThreadTS,
+			IsAdmin:      info.isAdmin,
+		}
+	}
+}
+
+func (p *providerSlackSocketMode) getUserInfo(id string) slackUserInfo {
+	p.mu.Lock()
+	if info, ok := p.users[id]; ok {
+		p.mu.Unlock()
+		return info
+	}
+	p.mu.Unlock()
+
+	resp, err := http.Get(fmt.Sprint(urlSlackAPI, "users.info?token=", p.botToken, "&user=", url.QueryEscape(id)))
+	if err != nil {
+		p.log.Error("failed reading user info - returning blank", err)
+		return slackUserInfo{}
+	}
+	defer resp.Body.Close()
+
+	var data struct {
+		OK   interface{} `json:"ok"`
+		User struct {
+			Name    string `json:"name"`
+			IsAdmin bool   `json:"is_admin"`
+		} `json:"user"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		p.log.Error("failed parsing user info - returning blank", err)
+		return slackUserInfo{}
+	}
+
+	info := slackUserInfo{name: data.User.Name, isAdmin: data.User.IsAdmin}
+	p.mu.Lock()
+	p.users[id] = info
+	p.mu.Unlock()
+	return info
+}
+
+// ack acknowledges a Socket Mode envelope by echoing back its envelope_id, as
+// required by the protocol.
+func (p *providerSlackSocketMode) ack(conn *websocket.Conn, envelopeID string) {
+	b, err := json.Marshal(struct {
+		EnvelopeID string `json:"envelope_id"`
+	}{envelopeID})
+	if err != nil {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+		p.log.Error("failed to ack socket mode envelope", err)
+	}
+}
+
+// dispatchLoop drains p.out for the lifetime of one connection. When done
+// or p.ctx fires it returns, leaving any unsent messages buffered in p.out
+// for the next session.
+func (p *providerSlackSocketMode) dispatchLoop(conn *websocket.Conn, done <-chan struct{}) {
+	p.log.Info("started socket mode dispatch loop")
+	for {
+		select {
+		case msg := <-p.out:
+			p.log.Debug("dispatching message", logging.Str("correlation_id", msg.CorrelationID), logging.Str("room", msg.Room))
+			if err := p.postMessage(msg); err != nil {
+				p.log.Error("failed to post message", err)
+			}
+		case <-done:
+			return
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// postMessage sends msg via chat.postMessage, uploading msg.Files through
+// files.upload first, when set. Socket Mode has no RTM-style websocket write
+// path, so every outbound message, rich or plain, goes through the Web API.
+func (p *providerSlackSocketMode) postMessage(msg messages.Message) error {
+	if len(msg.Files) > 0 {
+		if err := uploadFiles(p.botToken, msg); err != nil {
+			return err
+		}
+		if msg.Message == "" && len(msg.Attachments) == 0 && len(msg.Blocks) == 0 {
+			return nil
+		}
+	}
+
+	form := url.Values{}
+	form.Set("token", p.botToken)
+	form.Set("channel", msg.Room)
+	form.Set("text", msg.Message)
+	form.Set("as_user", "true")
+	if msg.ThreadTS != "" {
+		form.Set("thread_ts", msg.ThreadTS)
+	}
+	if msg.Username != "" {
+		form.Set("username", msg.Username)
+		form.Del("as_user")
+	}
+	if msg.IconEmoji != "" {
+		form.Set("icon_emoji", msg.IconEmoji)
+	}
+	if msg.IconURL != "" {
+		form.Set("icon_url", msg.IconURL)
+	}
+	if len(msg.Attachments) > 0 {
+		b, err := json.Marshal(toSlackAttachments(msg.Attachments))
+		if err != nil {
+			return err
+		}
+		form.Set("attachments", string(b))
+	}
+	if len(msg.Blocks) > 0 {
+		form.Set("blocks", string(msg.Blocks))
+	}
+
+	resp, err := http.PostForm(fmt.Sprint(urlSlackAPI, "chat.postMessage"), form)
+	if err != nil {
+		return err
+	}
+	return decodeSlackOK(resp)
+}
@@ -0,0 +1,71 @@
+//go:build all || slack
+// +build all slack
+
+package providers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextBackoff(t *testing.T) {
+	tests := []struct {
+		name string
+		in   time.Duration
+		want time.Duration
+	}{
+		{"doubles below cap", 1 * time.Second, 2 * time.Second},
+		{"doubles again", 10 * time.Second, 20 * time.Second},
+		{"caps at max", 40 * time.Second, maxReconnectBackoff},
+		{"stays capped once at max", maxReconnectBackoff, maxReconnectBackoff},
+		{"caps when doubling overshoots", 50 * time.Second, maxReconnectBackoff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextBackoff(tt.in); got != tt.want {
+				t.Errorf("nextBackoff(%s) = %s, want %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextBackoffMonotonicToCap(t *testing.T) {
+	d := minReconnectBackoff
+	for i := 0; i < 20; i++ {
+		next := nextBackoff(d)
+		if next < d {
+			t.Fatalf("nextBackoff(%s) = %s, want >= %s", d, next, d)
+		}
+		if next > maxReconnectBackoff {
+			t.Fatalf("nextBackoff(%s) = %s, want <= maxReconnectBackoff %s", d, next, maxReconnectBackoff)
+		}
+		d = next
+	}
+	if d != maxReconnectBackoff {
+		t.Fatalf("backoff did not converge to maxReconnectBackoff, got %s", d)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	tests := []struct {
+		name string
+		in   time.Duration
+	}{
+		{"one second", 1 * time.Second},
+		{"thirty seconds", 30 * time.Second},
+		{"at cap", maxReconnectBackoff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				got := jitter(tt.in)
+				if got < tt.in {
+					t.Fatalf("jitter(%s) = %s, want >= %s", tt.in, got, tt.in)
+				}
+				if max := tt.in + tt.in/2 + 1; got > max {
+					t.Fatalf("jitter(%s) = %s, want <= %s", tt.in, got, max)
+				}
+			}
+		})
+	}
+}